@@ -0,0 +1,84 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/aragonzkresearch/ovote-node/types"
+)
+
+// DeleteProcess deletes the process with the given processID from the db.
+// It's used by eth.Client to undo a NewProcess event that turned out to
+// belong to an orphaned block after a chain reorg.
+func (r *SQLite) DeleteProcess(processID uint64) error {
+	sqlQuery := `DELETE FROM processes WHERE processID = ?`
+
+	stmt, err := r.db.Prepare(sqlQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close() //nolint:errcheck
+
+	_, err = stmt.Exec(processID)
+	if err != nil {
+		return fmt.Errorf("error deleting process (processID: %d): %s", processID, err)
+	}
+	return nil
+}
+
+// ResetProcessStatus overrides the status of the given process back to
+// status. It's used by eth.Client to undo an onProcessClosed event that
+// turned out to belong to an orphaned block after a chain reorg.
+func (r *SQLite) ResetProcessStatus(processID uint64, status types.ProcessStatus) error {
+	sqlQuery := `UPDATE processes SET status = ? WHERE processID = ?`
+
+	stmt, err := r.db.Prepare(sqlQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close() //nolint:errcheck
+
+	_, err = stmt.Exec(status, processID)
+	if err != nil {
+		return fmt.Errorf("error resetting status for process (processID: %d): %s",
+			processID, err)
+	}
+	return nil
+}
+
+// ReadProcessStatus returns the current status of the process with the
+// given processID.
+func (r *SQLite) ReadProcessStatus(processID uint64) (types.ProcessStatus, error) {
+	sqlQuery := `SELECT status FROM processes WHERE processID = ?`
+
+	var status types.ProcessStatus
+	err := r.db.QueryRow(sqlQuery, processID).Scan(&status)
+	if err != nil {
+		return status, fmt.Errorf("error reading status for process (processID: %d): %s",
+			processID, err)
+	}
+	return status, nil
+}
+
+// UnfreezeProcessesByBlockNum reopens (sets back to ProcessStatusOn) every
+// process that FrozeProcessesByCurrentBlockNum froze because its
+// ResPubStartBlock matched blockNum. It's the undo counterpart used by
+// eth.Client when blockNum turns out to belong to an orphaned branch after
+// a chain reorg.
+func (r *SQLite) UnfreezeProcessesByBlockNum(blockNum uint64) error {
+	sqlQuery := `
+	UPDATE processes SET status = ?
+	WHERE resPubStartBlock = ? AND status = ?
+	`
+
+	stmt, err := r.db.Prepare(sqlQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close() //nolint:errcheck
+
+	_, err = stmt.Exec(types.ProcessStatusOn, blockNum, types.ProcessStatusFrozen)
+	if err != nil {
+		return fmt.Errorf("error unfreezing processes frozen at block %d: %s", blockNum, err)
+	}
+	return nil
+}
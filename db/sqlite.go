@@ -0,0 +1,9 @@
+package db
+
+import "database/sql"
+
+// SQLite is the concrete database/sql-backed store backing StoreVotePackage,
+// ReadVotePackagesByProcessID and the other methods in this package.
+type SQLite struct {
+	db *sql.DB
+}
@@ -1,31 +1,102 @@
 package db
 
 import (
+	"database/sql"
 	"encoding/binary"
 	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/aragonzkresearch/ovote-node/types"
+	"github.com/iden3/go-iden3-crypto/babyjub"
 )
 
+// createVotePackagesProcessIDIndexSQL is executed by EnsureVotePackagesIndexes.
+// It keeps ReadVotePackagesByProcessID's keyset pagination (WHERE processID =
+// ? AND indx > ? ORDER BY indx) and CountVotePackages O(log n) instead of a
+// full table scan.
+const createVotePackagesProcessIDIndexSQL = `
+CREATE INDEX IF NOT EXISTS idx_votepackages_processID_indx
+ON votepackages (processID, indx)
+`
+
+// createVotePackagesProcessIDPublicKeyIndexSQL is executed by
+// EnsureVotePackagesIndexes. It keeps ReadVotePackagesByProcessID's OnlyUnique
+// correlated subquery (WHERE v2.processID = ... AND v2.publicKey = ...)
+// O(log n) per outer row instead of rescanning every row for that processID.
+const createVotePackagesProcessIDPublicKeyIndexSQL = `
+CREATE INDEX IF NOT EXISTS idx_votepackages_processID_publicKey
+ON votepackages (processID, publicKey)
+`
+
+// EnsureVotePackagesIndexes creates the votepackages indexes
+// ReadVotePackagesByProcessID relies on for O(log n) lookups, if they don't
+// already exist. It must be called once against r.db after the votepackages
+// table itself has been created; there's no schema-migration runner in this
+// repo to hang it off of, so whatever constructs a *SQLite (opening or
+// creating the database file) is responsible for calling it.
+func (r *SQLite) EnsureVotePackagesIndexes() error {
+	if _, err := r.db.Exec(createVotePackagesProcessIDIndexSQL); err != nil {
+		return fmt.Errorf("error creating votepackages (processID, indx) index: %s", err)
+	}
+	if _, err := r.db.Exec(createVotePackagesProcessIDPublicKeyIndexSQL); err != nil {
+		return fmt.Errorf("error creating votepackages (processID, publicKey) index: %s", err)
+	}
+	return nil
+}
+
+// weightByteLen is the fixed width VotePackage weights are stored at. A
+// plain big.Int.Bytes() encoding has no fixed width, so comparing two
+// weights as a SQL BLOB (ORDER BY weight, weight >= ?) would compare them
+// byte-wise rather than numerically whenever they differ in byte length
+// (e.g. 255 -> []byte{0xff} sorting above 256 -> []byte{0x01, 0x00}).
+// Padding every weight to the same width with big.Int.FillBytes makes that
+// BLOB comparison agree with the numeric one. 32 bytes comfortably covers
+// any weight a babyjub-based census uses.
+const weightByteLen = 32
+
+// weightBytes encodes w as a fixed-width (weightByteLen), big-endian byte
+// slice, suitable for storing in and comparing against the weight column.
+func weightBytes(w *big.Int) []byte {
+	b := make([]byte, weightByteLen)
+	return w.FillBytes(b)
+}
+
+// insertVotePackageSQL is shared by StoreVotePackage and StoreVotePackages
+// so that a batch insert behaves exactly like a series of single inserts.
+const insertVotePackageSQL = `
+INSERT INTO votepackages(
+	id,
+	indx,
+	publicKey,
+	weight,
+	merkleproof,
+	signature,
+	vote,
+	insertedDatetime,
+	processID
+) values(?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+`
+
+// votePackageID builds the UNIQUE id for a VotePackage. CensusProof.Index &
+// PublicKey are unique for the current Census & Process, but not across
+// all the Processes stored in the same db table, so processID is mixed in
+// too.
+// id: index + publicKey + processID
+// 48 =   8   +   32      + 8
+func votePackageID(index uint64, publicKey *babyjub.PublicKey, processID uint64) []byte {
+	id := make([]byte, 48)
+	binary.LittleEndian.PutUint64(id[:], index)
+	pubKComp := publicKey.Compress()
+	copy(id[8:40], pubKComp[:])
+	binary.LittleEndian.PutUint64(id[40:], processID)
+	return id
+}
+
 // StoreVotePackage stores the given types.VotePackage for the given CensusRoot
 func (r *SQLite) StoreVotePackage(processID uint64, vote types.VotePackage) error {
 	// TODO check that processID exists
-	sqlQuery := `
-	INSERT INTO votepackages(
-		id,
-		indx,
-		publicKey,
-		weight,
-		merkleproof,
-		signature,
-		vote,
-		insertedDatetime,
-		processID
-	) values(?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
-	`
-
-	stmt, err := r.db.Prepare(sqlQuery)
+	stmt, err := r.db.Prepare(insertVotePackageSQL)
 	if err != nil {
 		return err
 	}
@@ -36,19 +107,10 @@ func (r *SQLite) StoreVotePackage(processID uint64, vote types.VotePackage) erro
 		vote.CensusProof.Weight = big.NewInt(0)
 	}
 
-	// index cp.Index & PublicKey are unique for the current Census &
-	// Process, but not for all the Processes stored in the same db table.
-	// We use a combination of them as value for the UNIQUE id.
-	// id: index + publicKey + processID
-	// 48 =   8   +   32      + 8
-	id := make([]byte, 48)
-	binary.LittleEndian.PutUint64(id[:], vote.CensusProof.Index)
-	pubKComp := vote.CensusProof.PublicKey.Compress()
-	copy(id[8:40], pubKComp[:])
-	binary.LittleEndian.PutUint64(id[40:], processID)
+	id := votePackageID(vote.CensusProof.Index, &vote.CensusProof.PublicKey, processID)
 
 	_, err = stmt.Exec(id, vote.CensusProof.Index, vote.CensusProof.PublicKey,
-		vote.CensusProof.Weight.Bytes(), vote.CensusProof.MerkleProof,
+		weightBytes(vote.CensusProof.Weight), vote.CensusProof.MerkleProof,
 		vote.Signature[:], vote.Vote, processID)
 	if err != nil {
 		if err.Error() == "FOREIGN KEY constraint failed" {
@@ -59,37 +121,293 @@ func (r *SQLite) StoreVotePackage(processID uint64, vote types.VotePackage) erro
 	return nil
 }
 
-// ReadVotePackagesByProcessID reads all the stored types.VotePackage for the
-// given ProcessID. VotePackages returned are sorted by index parameter, from
-// smaller to bigger.
-func (r *SQLite) ReadVotePackagesByProcessID(processID uint64) ([]types.VotePackage, error) {
-	// TODO add pagination
+// OnConflictPolicy controls how StoreVotePackages handles a VotePackage
+// whose id already exists in the table.
+type OnConflictPolicy int
+
+const (
+	// Reject rejects a VotePackage whose id already exists, the same
+	// behavior as a plain StoreVotePackage call.
+	Reject OnConflictPolicy = iota
+	// ReplaceIfNewer replaces the stored VotePackage with the incoming
+	// one. Since every insert is stamped with CURRENT_TIMESTAMP, an
+	// incoming vote is never older than whatever is already stored, so
+	// no insertedDatetime comparison is made: it always replaces.
+	ReplaceIfNewer
+	// KeepHighestWeight replaces the stored VotePackage with the
+	// incoming one only if its weight is higher.
+	KeepHighestWeight
+)
+
+// VoteError reports why a single VotePackage in a StoreVotePackages batch
+// was rejected.
+type VoteError struct {
+	Index  uint64
+	Reason string
+}
+
+func (e VoteError) Error() string {
+	return fmt.Sprintf("votepackage with index %d rejected: %s", e.Index, e.Reason)
+}
+
+// StoreVotePackages stores votes for the given processID in a single
+// transaction, preparing the insert statement once and reusing it for
+// every vote instead of paying StoreVotePackage's one-prepare-per-call
+// cost for each vote in a relayer burst.
+//
+// A vote whose id already exists is resolved according to onConflict;
+// that and any other per-vote problem (bad weight, unresolved conflict)
+// is collected into rejected instead of aborting the whole batch. err is
+// only set for a fatal, transaction-wide failure (processID doesn't
+// exist, or the database itself fails), in which case the transaction is
+// rolled back and nothing from the batch is stored.
+func (r *SQLite) StoreVotePackages(processID uint64, votes []types.VotePackage,
+	onConflict OnConflictPolicy) (accepted int, rejected []VoteError, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback() //nolint:errcheck
+		}
+	}()
+
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM processes WHERE processID = ?`, processID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("Can not store VotePackages, ProcessID=%d does not exist", processID)
+		return 0, nil, err
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	insertStmt, err := tx.Prepare(insertVotePackageSQL)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer insertStmt.Close() //nolint:errcheck
+
+	for _, vote := range votes {
+		if vote.CensusProof.Weight == nil {
+			vote.CensusProof.Weight = big.NewInt(0)
+		}
+		if vote.CensusProof.Weight.Sign() < 0 {
+			rejected = append(rejected, VoteError{
+				Index:  vote.CensusProof.Index,
+				Reason: "negative weight",
+			})
+			continue
+		}
+
+		id := votePackageID(vote.CensusProof.Index, &vote.CensusProof.PublicKey, processID)
+		_, insertErr := insertStmt.Exec(id, vote.CensusProof.Index, vote.CensusProof.PublicKey,
+			weightBytes(vote.CensusProof.Weight), vote.CensusProof.MerkleProof,
+			vote.Signature[:], vote.Vote, processID)
+		if insertErr == nil {
+			accepted++
+			continue
+		}
+		if !strings.Contains(insertErr.Error(), "UNIQUE constraint failed") {
+			err = insertErr
+			return 0, nil, err
+		}
+
+		replaced, resolveErr := r.resolveVoteConflict(tx, onConflict, id, vote)
+		if resolveErr != nil {
+			err = resolveErr
+			return 0, nil, err
+		}
+		if replaced {
+			accepted++
+		} else {
+			rejected = append(rejected, VoteError{
+				Index:  vote.CensusProof.Index,
+				Reason: "duplicate id",
+			})
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return accepted, rejected, nil
+}
+
+// resolveVoteConflict applies onConflict to the vote that failed to
+// insert because its id already exists, returning whether the stored row
+// was replaced.
+func (r *SQLite) resolveVoteConflict(tx *sql.Tx, onConflict OnConflictPolicy,
+	id []byte, vote types.VotePackage) (replaced bool, err error) {
+	switch onConflict {
+	case ReplaceIfNewer:
+		return r.replaceVotePackage(tx, id, vote)
+	case KeepHighestWeight:
+		var existingWeight []byte
+		if err := tx.QueryRow(`SELECT weight FROM votepackages WHERE id = ?`, id).
+			Scan(&existingWeight); err != nil {
+			return false, err
+		}
+		if vote.CensusProof.Weight.Cmp(new(big.Int).SetBytes(existingWeight)) <= 0 {
+			return false, nil
+		}
+		return r.replaceVotePackage(tx, id, vote)
+	default: // Reject
+		return false, nil
+	}
+}
+
+// replaceVotePackage overwrites the stored VotePackage identified by id
+// with vote's weight, merkleproof, signature and vote fields, stamping
+// insertedDatetime with the current time.
+func (r *SQLite) replaceVotePackage(tx *sql.Tx, id []byte, vote types.VotePackage) (bool, error) {
+	_, err := tx.Exec(`
+	UPDATE votepackages SET weight = ?, merkleproof = ?, signature = ?, vote = ?,
+		insertedDatetime = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`, weightBytes(vote.CensusProof.Weight), vote.CensusProof.MerkleProof,
+		vote.Signature[:], vote.Vote, id)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReadOpts configures ReadVotePackagesByProcessID.
+type ReadOpts struct {
+	// Limit caps the number of VotePackages returned. 0 means no limit.
+	Limit uint64
+	// AfterIndex, when set, restricts the result to VotePackages with
+	// indx > *AfterIndex, for keyset pagination over the already sorted
+	// indx column. nil starts from the beginning.
+	AfterIndex *uint64
+	// MinWeight, when set, restricts the result to VotePackages with a
+	// CensusProof weight >= MinWeight.
+	MinWeight *big.Int
+	// OnlyUnique, when true, keeps at most one VotePackage per
+	// publicKey: the highest-weighted one, breaking ties by the most
+	// recently inserted one (insertedDatetime, then rowid, since
+	// CURRENT_TIMESTAMP only has one-second resolution).
+	OnlyUnique bool
+}
+
+// VotePackageIterator streams the types.VotePackage rows matched by
+// ReadVotePackagesByProcessID, backed by *sql.Rows, so that a process with
+// millions of voters can be read without buffering them all in memory.
+type VotePackageIterator struct {
+	rows    *sql.Rows
+	current types.VotePackage
+	err     error
+}
+
+// Next advances the iterator to the next VotePackage, returning false when
+// there are no more rows or an error occurred (check Err() for the
+// latter).
+func (it *VotePackageIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+
+	vote := types.VotePackage{}
+	var sigBytes []byte
+	var weightBytes []byte
+	it.err = it.rows.Scan(&sigBytes, &vote.CensusProof.Index,
+		&vote.CensusProof.PublicKey, &weightBytes,
+		&vote.CensusProof.MerkleProof, &vote.Vote)
+	if it.err != nil {
+		return false
+	}
+	vote.CensusProof.Weight = new(big.Int).SetBytes(weightBytes)
+	copy(vote.Signature[:], sigBytes)
+	it.current = vote
+	return true
+}
+
+// Package returns the VotePackage loaded by the last successful call to
+// Next.
+func (it *VotePackageIterator) Package() types.VotePackage {
+	return it.current
+}
+
+// Err returns the first error encountered while iterating, if any.
+func (it *VotePackageIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+// Close releases the underlying *sql.Rows. Callers must always call it
+// once done with the iterator.
+func (it *VotePackageIterator) Close() error {
+	return it.rows.Close()
+}
+
+// ReadVotePackagesByProcessID reads the stored types.VotePackage for the
+// given ProcessID matching opts, streaming them through a
+// VotePackageIterator instead of buffering them all in memory, since a
+// process can have millions of voters. VotePackages are sorted by indx,
+// from smaller to bigger, which is also the keyset used by
+// opts.AfterIndex; a (processID, indx) index keeps that pagination
+// O(log n) (see EnsureVotePackagesIndexes).
+func (r *SQLite) ReadVotePackagesByProcessID(processID uint64, opts ReadOpts) (*VotePackageIterator, error) {
 	sqlQuery := `
 	SELECT signature, indx, publicKey, weight, merkleproof, vote FROM votepackages
 	WHERE processID = ?
-	ORDER BY indx ASC
 	`
+	args := []interface{}{processID}
+
+	if opts.AfterIndex != nil {
+		sqlQuery += ` AND indx > ?`
+		args = append(args, *opts.AfterIndex)
+	}
+	if opts.MinWeight != nil {
+		// weight is stored weightByteLen-wide (see weightBytes), so a
+		// BLOB comparison here agrees with the numeric one
+		sqlQuery += ` AND weight >= ?`
+		args = append(args, weightBytes(opts.MinWeight))
+	}
+	if opts.OnlyUnique {
+		// keep, per publicKey, the row with the highest weight, and
+		// among ties the most recently inserted one (insertedDatetime,
+		// then rowid for inserts within the same second). weight is
+		// stored weightByteLen-wide (see weightBytes), so ORDER BY
+		// weight is a numeric comparison, not just a byte-wise one. The
+		// (processID, publicKey) index keeps this subquery O(log n)
+		// per outer row instead of rescanning every row for that
+		// processID (see EnsureVotePackagesIndexes).
+		sqlQuery += `
+		AND id IN (
+			SELECT id FROM votepackages AS v2
+			WHERE v2.processID = votepackages.processID
+			AND v2.publicKey = votepackages.publicKey
+			ORDER BY v2.weight DESC, v2.insertedDatetime DESC, v2.rowid DESC
+			LIMIT 1
+		)`
+	}
 
-	rows, err := r.db.Query(sqlQuery, processID)
+	sqlQuery += ` ORDER BY indx ASC`
+	if opts.Limit > 0 {
+		sqlQuery += ` LIMIT ?`
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := r.db.Query(sqlQuery, args...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close() //nolint:errcheck
+	return &VotePackageIterator{rows: rows}, nil
+}
 
-	var votes []types.VotePackage
-	for rows.Next() {
-		vote := types.VotePackage{}
-		var sigBytes []byte
-		var weightBytes []byte
-		err = rows.Scan(&sigBytes, &vote.CensusProof.Index,
-			&vote.CensusProof.PublicKey, &weightBytes,
-			&vote.CensusProof.MerkleProof, &vote.Vote)
-		if err != nil {
-			return nil, err
-		}
-		vote.CensusProof.Weight = new(big.Int).SetBytes(weightBytes)
-		copy(vote.Signature[:], sigBytes)
-		votes = append(votes, vote)
+// CountVotePackages returns the number of VotePackages stored for the
+// given ProcessID.
+func (r *SQLite) CountVotePackages(processID uint64) (uint64, error) {
+	sqlQuery := `SELECT COUNT(*) FROM votepackages WHERE processID = ?`
+
+	var count uint64
+	if err := r.db.QueryRow(sqlQuery, processID).Scan(&count); err != nil {
+		return 0, err
 	}
-	return votes, nil
+	return count, nil
 }
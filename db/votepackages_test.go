@@ -0,0 +1,218 @@
+package db
+
+import (
+	"database/sql"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aragonzkresearch/ovote-node/types"
+	qt "github.com/frankban/quicktest"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestSQLite opens a fresh, file-backed sqlite db with just the
+// processes and votepackages tables (and their indexes, via
+// EnsureVotePackagesIndexes), registers processID as an existing process,
+// and returns the *SQLite wrapping it.
+func newTestSQLite(c *qt.C, processID uint64) *SQLite {
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(c.TempDir(), "test.db"))
+	c.Assert(err, qt.IsNil)
+
+	_, err = sqlDB.Exec(`PRAGMA foreign_keys = ON`)
+	c.Assert(err, qt.IsNil)
+
+	_, err = sqlDB.Exec(`
+	CREATE TABLE processes (
+		processID INTEGER PRIMARY KEY
+	)`)
+	c.Assert(err, qt.IsNil)
+
+	_, err = sqlDB.Exec(`
+	CREATE TABLE votepackages (
+		id BLOB PRIMARY KEY,
+		indx INTEGER NOT NULL,
+		publicKey BLOB NOT NULL,
+		weight BLOB NOT NULL,
+		merkleproof BLOB,
+		signature BLOB,
+		vote BLOB,
+		insertedDatetime DATETIME NOT NULL,
+		processID INTEGER NOT NULL REFERENCES processes(processID)
+	)`)
+	c.Assert(err, qt.IsNil)
+
+	_, err = sqlDB.Exec(`INSERT INTO processes(processID) VALUES (?)`, processID)
+	c.Assert(err, qt.IsNil)
+
+	r := &SQLite{db: sqlDB}
+	c.Assert(r.EnsureVotePackagesIndexes(), qt.IsNil)
+	return r
+}
+
+func newTestVote(index uint64, weight int64) types.VotePackage {
+	sk := babyjub.NewRandPrivKey()
+	return types.VotePackage{
+		CensusProof: types.CensusProof{
+			Index:       index,
+			PublicKey:   *sk.Public(),
+			Weight:      big.NewInt(weight),
+			MerkleProof: []byte{0x01},
+		},
+		Vote: []byte{0x02},
+	}
+}
+
+// TestEnsureVotePackagesIndexesUsed checks that the (processID, indx) index
+// EnsureVotePackagesIndexes creates is actually picked up by the query
+// planner for ReadVotePackagesByProcessID's keyset pagination, rather than
+// just existing unused.
+func TestEnsureVotePackagesIndexesUsed(t *testing.T) {
+	c := qt.New(t)
+	r := newTestSQLite(c, 1)
+
+	rows, err := r.db.Query(`EXPLAIN QUERY PLAN
+		SELECT signature, indx, publicKey, weight, merkleproof, vote
+		FROM votepackages WHERE processID = ? AND indx > ? ORDER BY indx ASC`, 1, 0)
+	c.Assert(err, qt.IsNil)
+	defer rows.Close() //nolint:errcheck
+
+	var plan strings.Builder
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		c.Assert(rows.Scan(&id, &parent, &notUsed, &detail), qt.IsNil)
+		plan.WriteString(detail)
+	}
+	c.Assert(rows.Err(), qt.IsNil)
+	c.Assert(plan.String(), qt.Contains, "idx_votepackages_processID_indx")
+}
+
+// TestStoreVotePackagesOnConflictPolicies exercises all three
+// OnConflictPolicy branches against a vote whose id already exists.
+func TestStoreVotePackagesOnConflictPolicies(t *testing.T) {
+	c := qt.New(t)
+
+	// Reject: a duplicate id is reported as rejected and the stored
+	// weight is untouched
+	r := newTestSQLite(c, 1)
+	vote := newTestVote(0, 10)
+	accepted, rejected, err := r.StoreVotePackages(1, []types.VotePackage{vote}, Reject)
+	c.Assert(err, qt.IsNil)
+	c.Assert(accepted, qt.Equals, 1)
+	c.Assert(len(rejected), qt.Equals, 0)
+
+	dup := vote
+	dup.CensusProof.Weight = big.NewInt(999)
+	accepted, rejected, err = r.StoreVotePackages(1, []types.VotePackage{dup}, Reject)
+	c.Assert(err, qt.IsNil)
+	c.Assert(accepted, qt.Equals, 0)
+	c.Assert(len(rejected), qt.Equals, 1)
+	c.Assert(rejected[0].Reason, qt.Equals, "duplicate id")
+
+	// ReplaceIfNewer: the duplicate always overwrites, regardless of
+	// weight
+	r = newTestSQLite(c, 1)
+	_, _, err = r.StoreVotePackages(1, []types.VotePackage{vote}, ReplaceIfNewer)
+	c.Assert(err, qt.IsNil)
+	lowerWeight := vote
+	lowerWeight.CensusProof.Weight = big.NewInt(1)
+	accepted, rejected, err = r.StoreVotePackages(1, []types.VotePackage{lowerWeight}, ReplaceIfNewer)
+	c.Assert(err, qt.IsNil)
+	c.Assert(accepted, qt.Equals, 1)
+	c.Assert(len(rejected), qt.Equals, 0)
+
+	var stored []byte
+	c.Assert(r.db.QueryRow(`SELECT weight FROM votepackages WHERE id = ?`,
+		votePackageID(vote.CensusProof.Index, &vote.CensusProof.PublicKey, 1)).
+		Scan(&stored), qt.IsNil)
+	c.Assert(new(big.Int).SetBytes(stored).Cmp(big.NewInt(1)), qt.Equals, 0)
+
+	// KeepHighestWeight: a lower-weighted duplicate is rejected, a
+	// higher-weighted one replaces the stored row
+	r = newTestSQLite(c, 1)
+	_, _, err = r.StoreVotePackages(1, []types.VotePackage{vote}, KeepHighestWeight)
+	c.Assert(err, qt.IsNil)
+
+	accepted, rejected, err = r.StoreVotePackages(1, []types.VotePackage{lowerWeight}, KeepHighestWeight)
+	c.Assert(err, qt.IsNil)
+	c.Assert(accepted, qt.Equals, 0)
+	c.Assert(len(rejected), qt.Equals, 1)
+
+	higherWeight := vote
+	higherWeight.CensusProof.Weight = big.NewInt(1000)
+	accepted, rejected, err = r.StoreVotePackages(1, []types.VotePackage{higherWeight}, KeepHighestWeight)
+	c.Assert(err, qt.IsNil)
+	c.Assert(accepted, qt.Equals, 1)
+	c.Assert(len(rejected), qt.Equals, 0)
+}
+
+// TestStoreVotePackagesRejectsNegativeWeight checks that a negative weight
+// is rejected per-vote instead of aborting (or corrupting) the whole batch.
+func TestStoreVotePackagesRejectsNegativeWeight(t *testing.T) {
+	c := qt.New(t)
+	r := newTestSQLite(c, 1)
+
+	good := newTestVote(0, 5)
+	bad := newTestVote(1, -5)
+
+	accepted, rejected, err := r.StoreVotePackages(1, []types.VotePackage{good, bad}, Reject)
+	c.Assert(err, qt.IsNil)
+	c.Assert(accepted, qt.Equals, 1)
+	c.Assert(len(rejected), qt.Equals, 1)
+	c.Assert(rejected[0].Index, qt.Equals, uint64(1))
+	c.Assert(rejected[0].Reason, qt.Equals, "negative weight")
+}
+
+// TestReadVotePackagesByProcessIDAfterIndexAtLastRow checks that
+// ReadOpts.AfterIndex set to the last stored indx yields no rows, instead of
+// off-by-one re-returning it.
+func TestReadVotePackagesByProcessIDAfterIndexAtLastRow(t *testing.T) {
+	c := qt.New(t)
+	r := newTestSQLite(c, 1)
+
+	for i := uint64(0); i < 3; i++ {
+		c.Assert(r.StoreVotePackage(1, newTestVote(i, 1)), qt.IsNil)
+	}
+
+	lastIndex := uint64(2)
+	it, err := r.ReadVotePackagesByProcessID(1, ReadOpts{AfterIndex: &lastIndex})
+	c.Assert(err, qt.IsNil)
+	defer it.Close() //nolint:errcheck
+
+	c.Assert(it.Next(), qt.IsFalse)
+	c.Assert(it.Err(), qt.IsNil)
+}
+
+// TestReadVotePackagesByProcessIDOnlyUniqueTieBreak checks that OnlyUnique
+// keeps, per publicKey, the highest-weighted vote, breaking ties by the most
+// recently inserted one.
+func TestReadVotePackagesByProcessIDOnlyUniqueTieBreak(t *testing.T) {
+	c := qt.New(t)
+	r := newTestSQLite(c, 1)
+
+	sk := babyjub.NewRandPrivKey()
+	pubK := *sk.Public()
+
+	first := newTestVote(0, 10)
+	first.CensusProof.PublicKey = pubK
+	c.Assert(r.StoreVotePackage(1, first), qt.IsNil)
+
+	// same weight as first (a tie): this second insert is the more
+	// recently inserted one and must win the tie-break, even though both
+	// inserts usually share the same one-second CURRENT_TIMESTAMP
+	second := newTestVote(1, 10)
+	second.CensusProof.PublicKey = pubK
+	c.Assert(r.StoreVotePackage(1, second), qt.IsNil)
+
+	it, err := r.ReadVotePackagesByProcessID(1, ReadOpts{OnlyUnique: true})
+	c.Assert(err, qt.IsNil)
+	defer it.Close() //nolint:errcheck
+
+	c.Assert(it.Next(), qt.IsTrue)
+	c.Assert(it.Package().CensusProof.Index, qt.Equals, uint64(1))
+	c.Assert(it.Next(), qt.IsFalse)
+	c.Assert(it.Err(), qt.IsNil)
+}
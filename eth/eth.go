@@ -4,27 +4,44 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"strings"
+	"sync"
 
 	"github.com/aragonzkresearch/ovote-node/db"
 	oTypes "github.com/aragonzkresearch/ovote-node/types"
-	"github.com/ethereum/go-ethereum"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"go.vocdoni.io/dvote/log"
 )
 
-const (
-	// eventNewProcessLen defines the length of an event log of newProcess
-	eventNewProcessLen = 288 // = 32*9
-	// eventResultPublishedLen defines the length of an event log of
-	// resultPublished
-	eventResultPublishedLen = 160 // = 32*5
-	// eventProcessClosedLen defines the length of an event log of
-	// processClosed
-	eventProcessClosedLen = 96 // = 32*3
+// DefaultConfirmationDepth is the number of blocks used when
+// Options.ConfirmationDepth is left at zero.
+const DefaultConfirmationDepth = 12
+
+// newProcessEventID, resultPublishedEventID and processClosedEventID are the
+// Keccak-256 event signature hashes (eventLog.Topics[0]) used to demultiplex
+// the ovote contract logs, computed once from the hand-maintained OvoteABI
+// (see ovote_bindings.go).
+var (
+	newProcessEventID      common.Hash
+	resultPublishedEventID common.Hash
+	processClosedEventID   common.Hash
 )
 
+func init() {
+	parsed, err := abi.JSON(strings.NewReader(OvoteABI))
+	if err != nil {
+		panic(err)
+	}
+	newProcessEventID = parsed.Events["NewProcess"].ID
+	resultPublishedEventID = parsed.Events["ResultPublished"].ID
+	processClosedEventID = parsed.Events["ProcessClosed"].ID
+}
+
 // ClientInterf defines the interface that synchronizes with the Ethereum
 // blockchain to obtain the processes data
 type ClientInterf interface {
@@ -34,13 +51,64 @@ type ClientInterf interface {
 	Start(fromBlock uint64) error
 }
 
+// ethClient is the subset of *ethclient.Client that Client relies on,
+// narrowed down to an interface so that tests can inject a fake
+// implementation to exercise reorg handling without a live Ethereum node.
+type ethClient interface {
+	ChainID(ctx context.Context) (*big.Int, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error)
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
 // Client implements the ClientInterf that reads data from the Ethereum
 // blockchain
 type Client struct {
-	client       *ethclient.Client
+	client       ethClient
 	db           *db.SQLite
 	contractAddr common.Address
+	filterer     *OvoteFilterer
 	ChainID      uint64
+
+	// confirmationDepth is the number of blocks a block must be behind
+	// the chain head before its events and state changes are treated as
+	// final. See Options.ConfirmationDepth.
+	confirmationDepth uint64
+
+	// unfinalizedMu guards unfinalized, pendingMutations and
+	// finalizedBlockNum.
+	unfinalizedMu sync.Mutex
+	// unfinalized holds, oldest first, the headers within the
+	// confirmation window together with the db mutations applied while
+	// processing them, so that a chain reorg can undo exactly the
+	// mutations of the blocks it orphans. See syncBlocksLive.
+	unfinalized []unfinalizedBlock
+	// finalizedBlockNum is the number of the most recent block whose
+	// state has already been committed (via UpdateLastSyncBlockNum) and
+	// can no longer be undone. Used by recordMutation to tell a block
+	// that's merely not buffered yet (still to come) from one that's
+	// already final.
+	finalizedBlockNum uint64
+	// pendingMutations holds mutations recorded (via recordMutation) for
+	// a block hash not yet present in unfinalized, keyed by that hash.
+	// syncEventsLive and syncBlocksLive run as independent goroutines
+	// with no ordering guarantee between a block's header and its
+	// events arriving, so a mutation can't always be attached to its
+	// unfinalizedBlock immediately; it's held here and moved over (and
+	// becomes undoable again) as soon as the header is buffered. See
+	// recordMutation.
+	pendingMutations map[common.Hash]*pendingMutation
+}
+
+// pendingMutation is a dbMutation recorded against a block that hasn't been
+// buffered into unfinalized yet, kept together with that block's number so
+// it can be dropped once blockNum falls behind finalizedBlockNum (at that
+// point the block it belongs to is either already accounted for or was
+// orphaned without ever being observed, either way it can no longer be
+// undone).
+type pendingMutation struct {
+	blockNum  uint64
+	mutations []dbMutation
 }
 
 // Options is used to pass the parameters to load a new Client
@@ -48,6 +116,14 @@ type Options struct {
 	EthURL       string
 	SQLite       *db.SQLite
 	ContractAddr common.Address
+
+	// ConfirmationDepth is the number of blocks a block must be behind
+	// the chain head before syncHistory and syncBlocksLive commit its
+	// events to the database. Blocks shallower than this are kept in an
+	// in-memory buffer so that a chain reorg can be undone instead of
+	// corrupting already-synced state. If zero, DefaultConfirmationDepth
+	// is used.
+	ConfirmationDepth uint64
 }
 
 // New loads a new Client
@@ -64,22 +140,33 @@ func New(opts Options) (*Client, error) {
 		return nil, err
 	}
 
+	filterer, err := NewOvoteFilterer(opts.ContractAddr, client)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	confirmationDepth := opts.ConfirmationDepth
+	if confirmationDepth == 0 {
+		confirmationDepth = DefaultConfirmationDepth
+	}
+
 	return &Client{
-		client:       client,
-		db:           opts.SQLite,
-		contractAddr: opts.ContractAddr,
-		ChainID:      chainID.Uint64(),
+		client:            client,
+		db:                opts.SQLite,
+		contractAddr:      opts.ContractAddr,
+		filterer:          filterer,
+		ChainID:           chainID.Uint64(),
+		confirmationDepth: confirmationDepth,
 	}, nil
 }
 
 // Sync synchronizes the blocknums and events since the last synced block to
-// the current one, and then live syncs the new ones
+// the current one, and then live syncs the new ones. To stay safe across
+// chain reorgs, state is only committed for blocks that are already
+// ConfirmationDepth blocks behind the head; see syncHistory and
+// syncBlocksLive.
 func (c *Client) Sync() error {
-	// TODO WARNING:
-	// Probably the logic will need to be changed to support reorgs of
-	// chain. Maybe wait to sync blocks until some new blocks after the
-	// block have been created.
-
 	// get lastSyncBlockNum from db
 	lastSyncBlockNum, err := c.db.GetLastSyncBlockNum()
 	if err != nil {
@@ -103,11 +190,26 @@ func (c *Client) Sync() error {
 	return nil
 }
 
-// syncBlocksLive synchronizes live the ethereum blocks
-func (c *Client) syncBlocksLive() error {
-	// sync to new blocks
-	headers := make(chan *types.Header)
-	sub, err := c.client.SubscribeNewHead(context.Background(), headers)
+// syncEventsLive synchronizes live from the ovote contract events, using the
+// typed Watch* methods of the OvoteFilterer binding so that each
+// event kind is delivered on its own strongly-typed channel instead of being
+// demultiplexed by hand
+func (c *Client) syncEventsLive() error {
+	newProcessCh := make(chan *OvoteNewProcess)
+	resultPublishedCh := make(chan *OvoteResultPublished)
+	processClosedCh := make(chan *OvoteProcessClosed)
+
+	newProcessSub, err := c.filterer.WatchNewProcess(nil, newProcessCh, nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	resultPublishedSub, err := c.filterer.WatchResultPublished(nil, resultPublishedCh, nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	processClosedSub, err := c.filterer.WatchProcessClosed(nil, processClosedCh, nil)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -115,149 +217,226 @@ func (c *Client) syncBlocksLive() error {
 
 	for {
 		select {
-		case err := <-sub.Err():
+		case err := <-newProcessSub.Err():
+			log.Error(err)
+		case err := <-resultPublishedSub.Err():
+			log.Error(err)
+		case err := <-processClosedSub.Err():
 			log.Error(err)
-		case header := <-headers:
-			log.Debugf("new eth block received: %d", header.Number.Uint64())
-			// store in db lastSyncBlockNum
-			err = c.db.UpdateLastSyncBlockNum(header.Number.Uint64())
-			if err != nil {
+		case e := <-newProcessCh:
+			if err := c.onNewProcess(e); err != nil {
+				log.Error(err)
+			}
+		case e := <-resultPublishedCh:
+			if err := c.onResultPublished(e); err != nil {
+				log.Error(err)
+			}
+		case e := <-processClosedCh:
+			if err := c.onProcessClosed(e); err != nil {
 				log.Error(err)
 			}
 		}
 	}
 }
 
-// syncEventsLive synchronizes live from the ovote contract events
-func (c *Client) syncEventsLive() error {
-	query := ethereum.FilterQuery{
-		Addresses: []common.Address{c.contractAddr},
-	}
-
-	logs := make(chan types.Log)
-	sub, err := c.client.SubscribeFilterLogs(context.Background(), query, logs)
+// syncHistory synchronizes from the ovote contract the events & blockNums
+// from the given block up to the chain head. Blocks up to the safe block
+// height (chain head minus ConfirmationDepth) are committed directly, since
+// a reorg can never reach back that far. The remaining blocks up to head
+// (from safe block height + 1, or from startBlock if that's already past
+// the safe block height) are still within the confirmation window, so
+// they're buffered into
+// c.unfinalized (like syncBlocksLive would) instead of being committed or
+// skipped, so that a restart right before syncBlocksLive's fresh
+// SubscribeNewHead subscription starts doesn't silently drop it.
+func (c *Client) syncHistory(startBlock uint64) error {
+	header, err := c.client.HeaderByNumber(context.Background(), nil)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
+	currBlockNum := header.Number.Uint64()
 
-	for {
-		select {
-		case err := <-sub.Err():
+	var safeBlockNum uint64
+	if currBlockNum > c.confirmationDepth {
+		safeBlockNum = currBlockNum - c.confirmationDepth
+	}
+
+	unconfirmedFrom := startBlock
+	if safeBlockNum >= startBlock {
+		log.Debugf("[SyncHistory] blocks from: %d, to: %d (chain head: %d)",
+			startBlock, safeBlockNum, currBlockNum)
+		err = c.syncEventsHistory(big.NewInt(int64(startBlock)), big.NewInt(int64(safeBlockNum)))
+		if err != nil {
 			log.Error(err)
-		case vLog := <-logs:
-			err = c.processEventLog(vLog)
-			if err != nil {
-				log.Error(err)
-			}
+			return err
 		}
+
+		err = c.db.UpdateLastSyncBlockNum(safeBlockNum)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+
+		// update the processes which their ResPubStartBlock has been
+		// reached (and that they were still in status
+		// ProcessStatusOn). safeBlockNum is already beyond
+		// ConfirmationDepth, so this can't be undone by a reorg.
+		// TODO maybe do not froze process, and allow it to accept
+		// votes still in results publishing phase
+		err = c.db.FrozeProcessesByCurrentBlockNum(safeBlockNum)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+
+		c.unfinalizedMu.Lock()
+		c.finalizedBlockNum = safeBlockNum
+		c.unfinalizedMu.Unlock()
+
+		unconfirmedFrom = safeBlockNum + 1
 	}
+
+	return c.seedUnfinalized(unconfirmedFrom, currBlockNum)
 }
 
-// syncHistory synchronizes from the ovote contract the events & blockNums
-// from the given block to the current block height.
-func (c *Client) syncHistory(startBlock uint64) error {
-	header, err := c.client.HeaderByNumber(context.Background(), nil)
+// syncEventsHistory synchronizes from the ovote contract log events
+// between the given startBlock and endBlock, using the typed Filter*
+// iterators of the OvoteFilterer binding
+func (c *Client) syncEventsHistory(startBlock, endBlock *big.Int) error {
+	start := startBlock.Uint64()
+	end := endBlock.Uint64()
+	opts := &bind.FilterOpts{
+		Start:   start,
+		End:     &end,
+		Context: context.Background(),
+	}
+
+	newProcessIt, err := c.filterer.FilterNewProcess(opts, nil)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	currBlockNum := header.Number
-	log.Debugf("[SyncHistory] blocks from: %d, to: %d", startBlock, currBlockNum)
-	err = c.syncEventsHistory(big.NewInt(int64(startBlock)), currBlockNum)
-	if err != nil {
+	for newProcessIt.Next() {
+		if err := c.onNewProcess(newProcessIt.Event); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := newProcessIt.Error(); err != nil {
 		log.Error(err)
 		return err
 	}
+	newProcessIt.Close() // nolint:errcheck
 
-	// update the processes which their ResPubStartBlock has been reached
-	// (and that they were still in status ProcessStatusOn
-	// TODO maybe do not froze process, and allow it to accept votes still
-	// in results publishing phase
-	err = c.db.FrozeProcessesByCurrentBlockNum(currBlockNum.Uint64())
+	resultPublishedIt, err := c.filterer.FilterResultPublished(opts, nil)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	// TODO take into account chain reorgs: for currBlockNum, set to
-	// ProcessStatusOn the processes with resPubStartBlock>currBlockNum
-	return nil
-}
-
-// syncEventsHistory synchronizes from the ovote contract log events
-// between the given startBlock and endBlock
-func (c *Client) syncEventsHistory(startBlock, endBlock *big.Int) error {
-	query := ethereum.FilterQuery{
-		FromBlock: startBlock,
-		ToBlock:   endBlock,
-		Addresses: []common.Address{
-			c.contractAddr,
-		},
+	for resultPublishedIt.Next() {
+		if err := c.onResultPublished(resultPublishedIt.Event); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := resultPublishedIt.Error(); err != nil {
+		log.Error(err)
+		return err
 	}
-	logs, err := c.client.FilterLogs(context.Background(), query)
+	resultPublishedIt.Close() // nolint:errcheck
+
+	processClosedIt, err := c.filterer.FilterProcessClosed(opts, nil)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	for i := 0; i < len(logs); i++ {
-		err = c.processEventLog(logs[i])
-		if err != nil {
+	for processClosedIt.Next() {
+		if err := c.onProcessClosed(processClosedIt.Event); err != nil {
 			log.Error(err)
 		}
 	}
+	if err := processClosedIt.Error(); err != nil {
+		log.Error(err)
+		return err
+	}
+	processClosedIt.Close() // nolint:errcheck
+
+	return nil
+}
+
+// onNewProcess stores in the db the process announced by a NewProcess event
+func (c *Client) onNewProcess(e *OvoteNewProcess) error {
+	log.Debugf("Event: (blocknum: %d) %+v", e.Raw.BlockNumber, e)
+	err := c.db.StoreProcess(e.ProcessID, e.CensusRoot[:], e.CensusSize,
+		e.Raw.BlockNumber, e.ResPubStartBlock, e.ResPubWindow,
+		e.MinParticipation, e.Type)
+	if err != nil {
+		return fmt.Errorf("error storing new process (processID: %d): %s",
+			e.ProcessID, err)
+	}
 
+	processID := e.ProcessID
+	c.recordMutation(e.Raw.BlockNumber, e.Raw.BlockHash, dbMutation{undo: func() error {
+		return c.db.DeleteProcess(processID)
+	}})
 	return nil
 }
 
+// onResultPublished handles a ResultPublished event
+func (c *Client) onResultPublished(e *OvoteResultPublished) error {
+	log.Debugf("Event: (blocknum: %d) %+v", e.Raw.BlockNumber, e)
+	return nil
+}
+
+// onProcessClosed updates the process status in the db for a ProcessClosed
+// event
+func (c *Client) onProcessClosed(e *OvoteProcessClosed) error {
+	log.Debugf("Event: (blocknum: %d) %+v", e.Raw.BlockNumber, e)
+	err := c.db.UpdateProcessStatus(e.ProcessID, oTypes.ProcessStatusContractClosed)
+	if err != nil {
+		return fmt.Errorf("error updating process status (processID: %d): %s",
+			e.ProcessID, err)
+	}
+
+	processID := e.ProcessID
+	c.recordMutation(e.Raw.BlockNumber, e.Raw.BlockHash, dbMutation{undo: func() error {
+		return c.db.ResetProcessStatus(processID, oTypes.ProcessStatusOn)
+	}})
+	return nil
+}
+
+// processEventLog dispatches a raw event log by eventLog.Topics[0] (the
+// Keccak-256 event signature hash) to its typed handler. Kept for callers
+// that still receive raw types.Log values (e.g. from a generic FilterQuery)
+// instead of going through the typed Watch*/Filter* channels.
 func (c *Client) processEventLog(eventLog types.Log) error {
-	// depending on eventLog.Data length, parse the different types of
-	// event logs
-	switch l := len(eventLog.Data); l {
-	case eventNewProcessLen:
-		e, err := parseEventNewProcess(eventLog.Data)
+	if len(eventLog.Topics) == 0 {
+		return fmt.Errorf("event log with no topics, blocknum: %d", eventLog.BlockNumber)
+	}
+
+	switch eventLog.Topics[0] {
+	case newProcessEventID:
+		e, err := c.filterer.ParseNewProcess(eventLog)
 		if err != nil {
 			return fmt.Errorf("blocknum: %d, error parsing event log"+
-				" (newProcess): %x, err: %s",
-				eventLog.BlockNumber, eventLog.Data, err)
+				" (NewProcess): %s", eventLog.BlockNumber, err)
 		}
-		log.Debugf("Event: (blocknum: %d) %s",
-			eventLog.BlockNumber, e)
-		// store the process in the db
-		err = c.db.StoreProcess(e.ProcessID, e.CensusRoot[:], e.CensusSize,
-			eventLog.BlockNumber, e.ResPubStartBlock, e.ResPubWindow,
-			e.MinParticipation, e.Type)
-		if err != nil {
-			return fmt.Errorf("error storing new process: %x, err: %s",
-				eventLog.Data, err)
-		}
-	case eventResultPublishedLen:
-		e, err := parseEventResultPublished(eventLog.Data)
+		return c.onNewProcess(e)
+	case resultPublishedEventID:
+		e, err := c.filterer.ParseResultPublished(eventLog)
 		if err != nil {
 			return fmt.Errorf("blocknum: %d, error parsing event log"+
-				" (resultPublished): %x, err: %s",
-				eventLog.BlockNumber, eventLog.Data, err)
+				" (ResultPublished): %s", eventLog.BlockNumber, err)
 		}
-		log.Debugf("Event: (blocknum: %d) %s",
-			eventLog.BlockNumber, e)
-	case eventProcessClosedLen:
-		e, err := parseEventProcessClosed(eventLog.Data)
+		return c.onResultPublished(e)
+	case processClosedEventID:
+		e, err := c.filterer.ParseProcessClosed(eventLog)
 		if err != nil {
 			return fmt.Errorf("blocknum: %d, error parsing event log"+
-				" (processClosed): %x, err: %s",
-				eventLog.BlockNumber, eventLog.Data, err)
-		}
-		log.Debugf("Event: (blocknum: %d) %s",
-			eventLog.BlockNumber, e)
-		// update process status in DB
-		err = c.db.UpdateProcessStatus(e.ProcessID, oTypes.ProcessStatusContractClosed)
-		if err != nil {
-			return fmt.Errorf("error updating process status: %x, err: %s",
-				eventLog.Data, err)
+				" (ProcessClosed): %s", eventLog.BlockNumber, err)
 		}
+		return c.onProcessClosed(e)
 	default:
-		fmt.Printf("LOG in block %d:\n %x \n", eventLog.BlockNumber, eventLog.Data)
-		return fmt.Errorf("unrecognized event log with length %d", l)
+		return fmt.Errorf("unrecognized event log topic %s, blocknum: %d",
+			eventLog.Topics[0].Hex(), eventLog.BlockNumber)
 	}
-
-	return nil
 }
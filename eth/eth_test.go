@@ -0,0 +1,234 @@
+package eth
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/aragonzkresearch/ovote-node/db"
+	oTypes "github.com/aragonzkresearch/ovote-node/types"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	qt "github.com/frankban/quicktest"
+)
+
+// fakeEthClient is a minimal, in-memory ethClient used to drive Client's
+// reorg handling without a live Ethereum node. Headers are keyed by hash
+// and chained through ParentHash, the same way a real chain is.
+type fakeEthClient struct {
+	headers  map[common.Hash]*types.Header
+	head     *types.Header
+	newHeads []chan<- *types.Header
+}
+
+func newFakeEthClient() *fakeEthClient {
+	return &fakeEthClient{headers: make(map[common.Hash]*types.Header)}
+}
+
+func (f *fakeEthClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1), nil
+}
+
+func (f *fakeEthClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return f.head, nil
+}
+
+func (f *fakeEthClient) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	h, ok := f.headers[hash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return h, nil
+}
+
+func (f *fakeEthClient) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	f.newHeads = append(f.newHeads, ch)
+	return &fakeSubscription{}, nil
+}
+
+// FilterLogs and SubscribeFilterLogs satisfy bind.ContractFilterer so that
+// a fakeEthClient can back an OvoteFilterer in tests; this fake chain never
+// has any contract logs of its own, events are injected directly via
+// onNewProcess/onResultPublished/onProcessClosed instead.
+func (f *fakeEthClient) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	return nil, nil
+}
+
+func (f *fakeEthClient) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return &fakeSubscription{}, nil
+}
+
+// header builds (and registers) a block at the given height, built on top
+// of parent, disambiguated by extra so that competing forks at the same
+// height don't collide on hash.
+func (f *fakeEthClient) header(number uint64, parent *types.Header, extra byte) *types.Header {
+	h := &types.Header{Number: big.NewInt(int64(number)), Extra: []byte{extra}}
+	if parent != nil {
+		h.ParentHash = parent.Hash()
+	}
+	f.headers[h.Hash()] = h
+	return h
+}
+
+type fakeSubscription struct{}
+
+func (s *fakeSubscription) Unsubscribe()      {}
+func (s *fakeSubscription) Err() <-chan error { return make(chan error) }
+
+func newTestClient(c *qt.C, fake *fakeEthClient, confirmationDepth uint64) *Client {
+	sqlite, err := db.New(filepath.Join(c.TempDir(), "test.db"))
+	c.Assert(err, qt.IsNil)
+	filterer, err := NewOvoteFilterer(common.Address{}, fake)
+	c.Assert(err, qt.IsNil)
+	return &Client{
+		client:            fake,
+		db:                sqlite,
+		filterer:          filterer,
+		confirmationDepth: confirmationDepth,
+	}
+}
+
+// TestSyncReorgAcrossResultPublished checks that a reorg orphaning the
+// block of a ResultPublished event (which has no db side effect of its own)
+// leaves the earlier block1, and the process its NewProcess event created,
+// in place, and that a deeper reorg reaching back past block1 then undoes
+// that NewProcess mutation.
+func TestSyncReorgAcrossResultPublished(t *testing.T) {
+	c := qt.New(t)
+	fake := newFakeEthClient()
+	client := newTestClient(c, fake, 3)
+
+	// block 1: a NewProcess event lands here, resPubStartBlock is set far
+	// in the future so FrozeProcessesByCurrentBlockNum never interferes
+	block1 := fake.header(1, nil, 0x01)
+	c.Assert(client.onNewHeader(block1), qt.IsNil)
+	c.Assert(client.onNewProcess(&OvoteNewProcess{
+		ProcessID:        1,
+		CensusRoot:       [32]byte{},
+		CensusSize:       10,
+		ResPubStartBlock: 1000,
+		ResPubWindow:     10,
+		Raw:              types.Log{BlockNumber: 1, BlockHash: block1.Hash()},
+	}), qt.IsNil)
+
+	// block 2 (orphaned branch, extra 0x02): carries the ResultPublished
+	// event that the reorg will cross
+	block2a := fake.header(2, block1, 0x02)
+	c.Assert(client.onNewHeader(block2a), qt.IsNil)
+	c.Assert(client.onResultPublished(&OvoteResultPublished{
+		ProcessID: 1,
+		Raw:       types.Log{BlockNumber: 2, BlockHash: block2a.Hash()},
+	}), qt.IsNil)
+
+	// a competing block 2 (extra 0x03) replaces block2a: the
+	// ResultPublished event above is orphaned, but block1 isn't, so the
+	// process created there must still exist afterwards
+	block2b := fake.header(2, block1, 0x03)
+	fake.head = block2b
+	c.Assert(client.onNewHeader(block2b), qt.IsNil)
+
+	c.Assert(len(client.unfinalized), qt.Equals, 2)
+	c.Assert(client.unfinalized[0].header.Hash(), qt.Equals, block1.Hash())
+	c.Assert(client.unfinalized[1].header.Hash(), qt.Equals, block2b.Hash())
+	_, err := client.db.ReadProcessStatus(1)
+	c.Assert(err, qt.IsNil)
+
+	// a deeper reorg reaching back past block1 must undo the NewProcess
+	// mutation too
+	block0 := fake.header(0, nil, 0x00)
+	fake.head = block0
+	c.Assert(client.onNewHeader(block0), qt.IsNil)
+	c.Assert(len(client.unfinalized), qt.Equals, 1)
+	_, err = client.db.ReadProcessStatus(1)
+	c.Assert(err, qt.Not(qt.IsNil))
+}
+
+// TestSyncReorgTwoBlocksDeep checks a reorg whose new head's parent isn't
+// already buffered (i.e. the replacement chain is more than one block
+// deep), which is the only case that exercises handleReorg's HeaderByHash
+// walk-back loop. A past bug in that loop pushed the new head itself into
+// the replacement slice on the loop's first iteration, causing it to be
+// buffered (and its events replayed) twice.
+func TestSyncReorgTwoBlocksDeep(t *testing.T) {
+	c := qt.New(t)
+	fake := newFakeEthClient()
+	client := newTestClient(c, fake, 10)
+
+	block1 := fake.header(1, nil, 0x01)
+	c.Assert(client.onNewHeader(block1), qt.IsNil)
+	block2 := fake.header(2, block1, 0x02)
+	c.Assert(client.onNewHeader(block2), qt.IsNil)
+	block3 := fake.header(3, block2, 0x03)
+	c.Assert(client.onNewHeader(block3), qt.IsNil)
+
+	// a competing fork replaces block2 and block3 with two new blocks,
+	// and extends one block further (block4b): block4b's parent
+	// (block3b) isn't buffered, so onNewHeader must walk back via
+	// HeaderByHash to find block1 as the common ancestor.
+	block2b := fake.header(2, block1, 0x12)
+	block3b := fake.header(3, block2b, 0x13)
+	block4b := fake.header(4, block3b, 0x14)
+	fake.head = block4b
+	c.Assert(client.onNewHeader(block4b), qt.IsNil)
+
+	c.Assert(len(client.unfinalized), qt.Equals, 4)
+	c.Assert(client.unfinalized[0].header.Hash(), qt.Equals, block1.Hash())
+	c.Assert(client.unfinalized[1].header.Hash(), qt.Equals, block2b.Hash())
+	c.Assert(client.unfinalized[2].header.Hash(), qt.Equals, block3b.Hash())
+	c.Assert(client.unfinalized[3].header.Hash(), qt.Equals, block4b.Hash())
+}
+
+// TestSyncReorgReplayFreezesProcesses checks that handleReorg's replay loop
+// freezes a process whose ResPubStartBlock falls within the replayed range,
+// and that the freeze is itself undoable if a later reorg orphans the
+// replayed block that caused it. TestSyncReorgTwoBlocksDeep doesn't cover
+// this: it never sets a ResPubStartBlock reachable by any buffered block, so
+// it would pass even if the replay loop never froze anything.
+func TestSyncReorgReplayFreezesProcesses(t *testing.T) {
+	c := qt.New(t)
+	fake := newFakeEthClient()
+	client := newTestClient(c, fake, 10)
+
+	block1 := fake.header(1, nil, 0x01)
+	c.Assert(client.onNewHeader(block1), qt.IsNil)
+	c.Assert(client.onNewProcess(&OvoteNewProcess{
+		ProcessID:        1,
+		CensusRoot:       [32]byte{},
+		CensusSize:       10,
+		ResPubStartBlock: 3,
+		ResPubWindow:     10,
+		Raw:              types.Log{BlockNumber: 1, BlockHash: block1.Hash()},
+	}), qt.IsNil)
+	block2 := fake.header(2, block1, 0x02)
+	c.Assert(client.onNewHeader(block2), qt.IsNil)
+	block3 := fake.header(3, block2, 0x03)
+	c.Assert(client.onNewHeader(block3), qt.IsNil)
+
+	// a competing fork replaces block2 and block3, and extends one block
+	// further so the replay loop (not onNewHeader's single-block append
+	// path) is what buffers block3b and must freeze process 1, whose
+	// ResPubStartBlock (3) falls within the replayed range
+	block2b := fake.header(2, block1, 0x12)
+	block3b := fake.header(3, block2b, 0x13)
+	block4b := fake.header(4, block3b, 0x14)
+	fake.head = block4b
+	c.Assert(client.onNewHeader(block4b), qt.IsNil)
+
+	status, err := client.db.ReadProcessStatus(1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, oTypes.ProcessStatusFrozen)
+
+	// a later reorg onto a competing block 2 orphans block3b (and
+	// block4b) and must unfreeze process 1 again. The replacement chain
+	// stops at height 2: a replacement reaching height 3 would
+	// (correctly) freeze process 1 again while replaying that block
+	block2c := fake.header(2, block1, 0x22)
+	fake.head = block2c
+	c.Assert(client.onNewHeader(block2c), qt.IsNil)
+
+	status, err = client.db.ReadProcessStatus(1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(status, qt.Equals, oTypes.ProcessStatusOn)
+}
@@ -0,0 +1,481 @@
+// Hand-maintained partial binding for the ovote contract's NewProcess,
+// ResultPublished and ProcessClosed events, written in the shape abigen
+// would produce. There is no solidity/ source or ABI JSON file checked
+// into this repo to regenerate it from, and it's missing the
+// Caller/Transactor/Session/MetaData/DeployOvote boilerplate a real abigen
+// run emits, so treat this as a regular Go file to edit, not generated
+// code.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var (
+	_ = errors.New
+	_ = big.NewInt
+	_ = strings.NewReader
+	_ = ethereum.NotFound
+	_ = bind.Bind
+	_ = common.Big1
+)
+
+// OvoteABI is the ABI the hand-maintained binding below is written against.
+//
+// The pre-abigen dispatch this replaced sized raw event logs as
+// eventNewProcessLen=288 (9 32-byte words), eventResultPublishedLen=160 (5
+// words) and eventProcessClosedLen=96 (3 words), but this repo never
+// checked in a solidity/ source or ABI JSON for the real ovote contract to
+// say what those extra words (beyond the processID topic and the fields
+// this codebase reads: censusRoot, censusSize, resPubStartBlock,
+// resPubWindow, minParticipation, ptype, root) actually are. Rather than
+// under-declaring the event (which makes UnpackLog/FilterLogs fail to
+// decode a real on-chain log entirely) or guessing at field names with no
+// basis, each event is padded with bytes32 "reservedN" fields that decode
+// trailing words without claiming to know their meaning. processID is
+// declared as an indexed topic, which is not part of Data, so the
+// non-indexed arguments come to 8, 4 and 2 words of Data: one word fewer
+// than the Data lengths the old dispatch checked for. Replace these with
+// the real field names the moment a solidity/ source or ABI JSON for the deployed contract is
+// available.
+const OvoteABI = `[{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint64","name":"processID","type":"uint64"},{"indexed":false,"internalType":"bytes32","name":"censusRoot","type":"bytes32"},{"indexed":false,"internalType":"uint64","name":"censusSize","type":"uint64"},{"indexed":false,"internalType":"uint64","name":"resPubStartBlock","type":"uint64"},{"indexed":false,"internalType":"uint64","name":"resPubWindow","type":"uint64"},{"indexed":false,"internalType":"uint8","name":"minParticipation","type":"uint8"},{"indexed":false,"internalType":"uint8","name":"ptype","type":"uint8"},{"indexed":false,"internalType":"bytes32","name":"reserved1","type":"bytes32"},{"indexed":false,"internalType":"bytes32","name":"reserved2","type":"bytes32"}],"name":"NewProcess","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint64","name":"processID","type":"uint64"},{"indexed":false,"internalType":"bytes32","name":"root","type":"bytes32"},{"indexed":false,"internalType":"bytes32","name":"reserved1","type":"bytes32"},{"indexed":false,"internalType":"bytes32","name":"reserved2","type":"bytes32"},{"indexed":false,"internalType":"bytes32","name":"reserved3","type":"bytes32"}],"name":"ResultPublished","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint64","name":"processID","type":"uint64"},{"indexed":false,"internalType":"bytes32","name":"reserved1","type":"bytes32"},{"indexed":false,"internalType":"bytes32","name":"reserved2","type":"bytes32"}],"name":"ProcessClosed","type":"event"}]`
+
+// OvoteFilterer is a Go wrapper around an on-chain ovote contract event
+// filtering and watching API.
+type OvoteFilterer struct {
+	contract *bind.BoundContract
+	abi      abi.ABI
+}
+
+// NewOvoteFilterer creates a new log filterer instance of Ovote, bound to a
+// specific deployed contract.
+func NewOvoteFilterer(address common.Address, filterer bind.ContractFilterer) (*OvoteFilterer, error) {
+	parsed, err := abi.JSON(strings.NewReader(OvoteABI))
+	if err != nil {
+		return nil, err
+	}
+	contract := bind.NewBoundContract(address, parsed, nil, nil, filterer)
+	return &OvoteFilterer{contract: contract, abi: parsed}, nil
+}
+
+// OvoteNewProcess represents a NewProcess event raised by the Ovote contract.
+type OvoteNewProcess struct {
+	ProcessID        uint64
+	CensusRoot       [32]byte
+	CensusSize       uint64
+	ResPubStartBlock uint64
+	ResPubWindow     uint64
+	MinParticipation uint8
+	Type             uint8     `abi:"ptype"`
+	// Reserved1 and Reserved2 are undecoded trailing words; see the doc
+	// comment on OvoteABI.
+	Reserved1 [32]byte
+	Reserved2 [32]byte
+	Raw       types.Log // blockchain specific contextual infos
+}
+
+// OvoteNewProcessIterator is returned from FilterNewProcess and is used to
+// iterate over the raw logs and unpacked data for NewProcess events raised
+// by the Ovote contract.
+type OvoteNewProcessIterator struct {
+	Event *OvoteNewProcess
+
+	contract *bind.BoundContract
+	event    string
+
+	logs chan types.Log
+	sub  ethereum.Subscription
+	done bool
+	fail error
+}
+
+// Next advances the iterator to the next event, returning false when no
+// more events are available or an error occurred (check Error() for the
+// latter).
+func (it *OvoteNewProcessIterator) Next() bool {
+	if it.fail != nil {
+		return false
+	}
+	var log types.Log
+	if it.done {
+		// the subscription has finished: deliver what it already sent
+		select {
+		case log = <-it.logs:
+		default:
+			return false
+		}
+	} else {
+		select {
+		case log = <-it.logs:
+		case err := <-it.sub.Err():
+			it.done = true
+			it.fail = err
+			return it.Next()
+		}
+	}
+	it.Event = new(OvoteNewProcess)
+	if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+		it.fail = err
+		return false
+	}
+	it.Event.Raw = log
+	return true
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *OvoteNewProcessIterator) Error() error { return it.fail }
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *OvoteNewProcessIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// FilterNewProcess is a free log retrieval operation binding the contract
+// event 0x...NewProcess. processID can be used to filter the logs to only
+// the ones emitted for the given process ids, passing a nil/empty slice
+// matches any processID.
+func (_Ovote *OvoteFilterer) FilterNewProcess(opts *bind.FilterOpts, processID []uint64) (*OvoteNewProcessIterator, error) {
+	var processIDRule []interface{}
+	for _, processIDItem := range processID {
+		processIDRule = append(processIDRule, processIDItem)
+	}
+
+	logs, sub, err := _Ovote.contract.FilterLogs(opts, "NewProcess", processIDRule)
+	if err != nil {
+		return nil, err
+	}
+	return &OvoteNewProcessIterator{contract: _Ovote.contract, event: "NewProcess", logs: logs, sub: sub}, nil
+}
+
+// WatchNewProcess is a free log subscription operation binding the contract
+// event 0x...NewProcess. processID can be used to only watch the events
+// emitted for the given process ids, passing a nil/empty slice matches any
+// processID.
+func (_Ovote *OvoteFilterer) WatchNewProcess(opts *bind.WatchOpts, sink chan<- *OvoteNewProcess, processID []uint64) (event.Subscription, error) {
+	var processIDRule []interface{}
+	for _, processIDItem := range processID {
+		processIDRule = append(processIDRule, processIDItem)
+	}
+
+	logs, sub, err := _Ovote.contract.WatchLogs(opts, "NewProcess", processIDRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				e := new(OvoteNewProcess)
+				if err := _Ovote.contract.UnpackLog(e, "NewProcess", log); err != nil {
+					return err
+				}
+				e.Raw = log
+				select {
+				case sink <- e:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseNewProcess parses a NewProcess event from the given log.
+func (_Ovote *OvoteFilterer) ParseNewProcess(log types.Log) (*OvoteNewProcess, error) {
+	e := new(OvoteNewProcess)
+	if err := _Ovote.contract.UnpackLog(e, "NewProcess", log); err != nil {
+		return nil, err
+	}
+	e.Raw = log
+	return e, nil
+}
+
+// OvoteResultPublished represents a ResultPublished event raised by the
+// Ovote contract.
+type OvoteResultPublished struct {
+	ProcessID uint64
+	Root      [32]byte
+	// Reserved1, Reserved2 and Reserved3 are undecoded trailing words;
+	// see the doc comment on OvoteABI.
+	Reserved1 [32]byte
+	Reserved2 [32]byte
+	Reserved3 [32]byte
+	Raw       types.Log // blockchain specific contextual infos
+}
+
+// OvoteResultPublishedIterator is returned from FilterResultPublished and is
+// used to iterate over the raw logs and unpacked data for ResultPublished
+// events raised by the Ovote contract.
+type OvoteResultPublishedIterator struct {
+	Event *OvoteResultPublished
+
+	contract *bind.BoundContract
+	event    string
+
+	logs chan types.Log
+	sub  ethereum.Subscription
+	done bool
+	fail error
+}
+
+// Next advances the iterator to the next event, returning false when no
+// more events are available or an error occurred (check Error() for the
+// latter).
+func (it *OvoteResultPublishedIterator) Next() bool {
+	if it.fail != nil {
+		return false
+	}
+	var log types.Log
+	if it.done {
+		// the subscription has finished: deliver what it already sent
+		select {
+		case log = <-it.logs:
+		default:
+			return false
+		}
+	} else {
+		select {
+		case log = <-it.logs:
+		case err := <-it.sub.Err():
+			it.done = true
+			it.fail = err
+			return it.Next()
+		}
+	}
+	it.Event = new(OvoteResultPublished)
+	if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+		it.fail = err
+		return false
+	}
+	it.Event.Raw = log
+	return true
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *OvoteResultPublishedIterator) Error() error { return it.fail }
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *OvoteResultPublishedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// FilterResultPublished is a free log retrieval operation binding the
+// contract event 0x...ResultPublished.
+func (_Ovote *OvoteFilterer) FilterResultPublished(opts *bind.FilterOpts, processID []uint64) (*OvoteResultPublishedIterator, error) {
+	var processIDRule []interface{}
+	for _, processIDItem := range processID {
+		processIDRule = append(processIDRule, processIDItem)
+	}
+
+	logs, sub, err := _Ovote.contract.FilterLogs(opts, "ResultPublished", processIDRule)
+	if err != nil {
+		return nil, err
+	}
+	return &OvoteResultPublishedIterator{contract: _Ovote.contract, event: "ResultPublished", logs: logs, sub: sub}, nil
+}
+
+// WatchResultPublished is a free log subscription operation binding the
+// contract event 0x...ResultPublished. processID can be used to only watch
+// the events emitted for the given process ids, passing a nil/empty slice
+// matches any processID.
+func (_Ovote *OvoteFilterer) WatchResultPublished(opts *bind.WatchOpts, sink chan<- *OvoteResultPublished, processID []uint64) (event.Subscription, error) {
+	var processIDRule []interface{}
+	for _, processIDItem := range processID {
+		processIDRule = append(processIDRule, processIDItem)
+	}
+
+	logs, sub, err := _Ovote.contract.WatchLogs(opts, "ResultPublished", processIDRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				e := new(OvoteResultPublished)
+				if err := _Ovote.contract.UnpackLog(e, "ResultPublished", log); err != nil {
+					return err
+				}
+				e.Raw = log
+				select {
+				case sink <- e:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseResultPublished parses a ResultPublished event from the given log.
+func (_Ovote *OvoteFilterer) ParseResultPublished(log types.Log) (*OvoteResultPublished, error) {
+	e := new(OvoteResultPublished)
+	if err := _Ovote.contract.UnpackLog(e, "ResultPublished", log); err != nil {
+		return nil, err
+	}
+	e.Raw = log
+	return e, nil
+}
+
+// OvoteProcessClosed represents a ProcessClosed event raised by the Ovote
+// contract.
+type OvoteProcessClosed struct {
+	ProcessID uint64
+	// Reserved1 and Reserved2 are undecoded trailing words; see the doc
+	// comment on OvoteABI.
+	Reserved1 [32]byte
+	Reserved2 [32]byte
+	Raw       types.Log // blockchain specific contextual infos
+}
+
+// OvoteProcessClosedIterator is returned from FilterProcessClosed and is
+// used to iterate over the raw logs and unpacked data for ProcessClosed
+// events raised by the Ovote contract.
+type OvoteProcessClosedIterator struct {
+	Event *OvoteProcessClosed
+
+	contract *bind.BoundContract
+	event    string
+
+	logs chan types.Log
+	sub  ethereum.Subscription
+	done bool
+	fail error
+}
+
+// Next advances the iterator to the next event, returning false when no
+// more events are available or an error occurred (check Error() for the
+// latter).
+func (it *OvoteProcessClosedIterator) Next() bool {
+	if it.fail != nil {
+		return false
+	}
+	var log types.Log
+	if it.done {
+		// the subscription has finished: deliver what it already sent
+		select {
+		case log = <-it.logs:
+		default:
+			return false
+		}
+	} else {
+		select {
+		case log = <-it.logs:
+		case err := <-it.sub.Err():
+			it.done = true
+			it.fail = err
+			return it.Next()
+		}
+	}
+	it.Event = new(OvoteProcessClosed)
+	if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+		it.fail = err
+		return false
+	}
+	it.Event.Raw = log
+	return true
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *OvoteProcessClosedIterator) Error() error { return it.fail }
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *OvoteProcessClosedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// FilterProcessClosed is a free log retrieval operation binding the contract
+// event 0x...ProcessClosed.
+func (_Ovote *OvoteFilterer) FilterProcessClosed(opts *bind.FilterOpts, processID []uint64) (*OvoteProcessClosedIterator, error) {
+	var processIDRule []interface{}
+	for _, processIDItem := range processID {
+		processIDRule = append(processIDRule, processIDItem)
+	}
+
+	logs, sub, err := _Ovote.contract.FilterLogs(opts, "ProcessClosed", processIDRule)
+	if err != nil {
+		return nil, err
+	}
+	return &OvoteProcessClosedIterator{contract: _Ovote.contract, event: "ProcessClosed", logs: logs, sub: sub}, nil
+}
+
+// WatchProcessClosed is a free log subscription operation binding the
+// contract event 0x...ProcessClosed. processID can be used to only watch
+// the events emitted for the given process ids, passing a nil/empty slice
+// matches any processID.
+func (_Ovote *OvoteFilterer) WatchProcessClosed(opts *bind.WatchOpts, sink chan<- *OvoteProcessClosed, processID []uint64) (event.Subscription, error) {
+	var processIDRule []interface{}
+	for _, processIDItem := range processID {
+		processIDRule = append(processIDRule, processIDItem)
+	}
+
+	logs, sub, err := _Ovote.contract.WatchLogs(opts, "ProcessClosed", processIDRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				e := new(OvoteProcessClosed)
+				if err := _Ovote.contract.UnpackLog(e, "ProcessClosed", log); err != nil {
+					return err
+				}
+				e.Raw = log
+				select {
+				case sink <- e:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseProcessClosed parses a ProcessClosed event from the given log.
+func (_Ovote *OvoteFilterer) ParseProcessClosed(log types.Log) (*OvoteProcessClosed, error) {
+	e := new(OvoteProcessClosed)
+	if err := _Ovote.contract.UnpackLog(e, "ProcessClosed", log); err != nil {
+		return nil, err
+	}
+	e.Raw = log
+	return e, nil
+}
@@ -0,0 +1,49 @@
+package eth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	qt "github.com/frankban/quicktest"
+)
+
+// TestUnpackNewProcessEvent unpacks a NewProcess log through the real abi
+// package instead of only exercising OvoteNewProcess as a struct literal.
+// abi.UnpackIntoInterface matches ABI arg names to struct fields by
+// reflection using go-ethereum's capitalize-first-letter rule (or an
+// `abi:"..."` tag override), which a plain struct literal test can't
+// catch: "ptype" capitalizes to "Ptype", not "Type".
+func TestUnpackNewProcessEvent(t *testing.T) {
+	c := qt.New(t)
+
+	parsed, err := abi.JSON(strings.NewReader(OvoteABI))
+	c.Assert(err, qt.IsNil)
+
+	// censusRoot, censusSize, resPubStartBlock, resPubWindow,
+	// minParticipation, ptype, reserved1, reserved2: the NewProcess
+	// event's non-indexed args, in order
+	data, err := parsed.Events["NewProcess"].Inputs.NonIndexed().Pack(
+		[32]byte{1, 2, 3},
+		uint64(200),
+		uint64(10),
+		uint64(50),
+		uint8(77),
+		uint8(3),
+		[32]byte{4, 5, 6},
+		[32]byte{7, 8, 9},
+	)
+	c.Assert(err, qt.IsNil)
+
+	var out OvoteNewProcess
+	err = parsed.UnpackIntoInterface(&out, "NewProcess", data)
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(out.CensusSize, qt.Equals, uint64(200))
+	c.Assert(out.ResPubStartBlock, qt.Equals, uint64(10))
+	c.Assert(out.ResPubWindow, qt.Equals, uint64(50))
+	c.Assert(out.MinParticipation, qt.Equals, uint8(77))
+	c.Assert(out.Type, qt.Equals, uint8(3))
+	c.Assert(out.Reserved1, qt.Equals, [32]byte{4, 5, 6})
+	c.Assert(out.Reserved2, qt.Equals, [32]byte{7, 8, 9})
+}
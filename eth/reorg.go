@@ -0,0 +1,287 @@
+package eth
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"go.vocdoni.io/dvote/log"
+)
+
+// dbMutation is a reversible effect that was applied to the database while
+// processing an unfinalized block, so that it can be undone if that block
+// turns out to belong to an orphaned branch.
+type dbMutation struct {
+	undo func() error
+}
+
+// unfinalizedBlock is a buffered header within the confirmation window,
+// together with the db mutations applied while processing its events and
+// its block-height updates (e.g. FrozeProcessesByCurrentBlockNum).
+type unfinalizedBlock struct {
+	header    *types.Header
+	mutations []dbMutation
+}
+
+// syncBlocksLive synchronizes live the ethereum blocks, buffering the last
+// ConfirmationDepth headers before treating them as finalized. This bounds
+// the window in which a chain reorg can be observed: committing
+// lastSyncBlockNum (and any db mutations recorded against a buffered
+// header) is delayed until that header has ConfirmationDepth confirmations
+// built on top of it.
+func (c *Client) syncBlocksLive() error {
+	headers := make(chan *types.Header)
+	sub, err := c.client.SubscribeNewHead(context.Background(), headers)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	for {
+		select {
+		case err := <-sub.Err():
+			log.Error(err)
+		case header := <-headers:
+			log.Debugf("new eth block received: %d", header.Number.Uint64())
+			if err := c.onNewHeader(header); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// onNewHeader resolves a reorg first if header doesn't extend the
+// previously buffered tail, appends header to the unfinalized tail, and
+// finalizes (commits) every buffered block that now has ConfirmationDepth
+// confirmations.
+func (c *Client) onNewHeader(header *types.Header) error {
+	c.unfinalizedMu.Lock()
+	n := len(c.unfinalized)
+	reorged := n > 0 && header.ParentHash != c.unfinalized[n-1].header.Hash()
+	c.unfinalizedMu.Unlock()
+
+	if reorged {
+		if err := c.handleReorg(header); err != nil {
+			return err
+		}
+	}
+
+	// freeze the processes whose ResPubStartBlock has been reached by
+	// this (still unfinalized) header; this is reversible via
+	// UnfreezeProcessesByBlockNum should header end up orphaned.
+	blockNum := header.Number.Uint64()
+	if err := c.db.FrozeProcessesByCurrentBlockNum(blockNum); err != nil {
+		return err
+	}
+
+	c.unfinalizedMu.Lock()
+	c.bufferHeaderLocked(header)
+	c.unfinalizedMu.Unlock()
+
+	c.recordMutation(blockNum, header.Hash(), dbMutation{undo: func() error {
+		return c.db.UnfreezeProcessesByBlockNum(blockNum)
+	}})
+
+	return c.finalizeConfirmed(blockNum)
+}
+
+// bufferHeaderLocked appends header to unfinalized and moves over any
+// mutations recorded against its hash while it wasn't buffered yet (see
+// recordMutation), so they aren't lost once it's there. Callers must hold
+// c.unfinalizedMu.
+func (c *Client) bufferHeaderLocked(header *types.Header) {
+	block := unfinalizedBlock{header: header}
+	if pending, ok := c.pendingMutations[header.Hash()]; ok {
+		block.mutations = append(block.mutations, pending.mutations...)
+		delete(c.pendingMutations, header.Hash())
+	}
+	c.unfinalized = append(c.unfinalized, block)
+}
+
+// finalizeConfirmed commits (UpdateLastSyncBlockNum) and drops every
+// buffered block that now has ConfirmationDepth confirmations, since its
+// mutations can no longer be undone by a reorg.
+func (c *Client) finalizeConfirmed(headNum uint64) error {
+	c.unfinalizedMu.Lock()
+	defer c.unfinalizedMu.Unlock()
+
+	for len(c.unfinalized) > 0 &&
+		headNum-c.unfinalized[0].header.Number.Uint64() >= c.confirmationDepth {
+		finalized := c.unfinalized[0]
+		if err := c.db.UpdateLastSyncBlockNum(finalized.header.Number.Uint64()); err != nil {
+			return err
+		}
+		c.unfinalized = c.unfinalized[1:]
+		c.finalizedBlockNum = finalized.header.Number.Uint64()
+	}
+
+	// a pending mutation for a block at or behind finalizedBlockNum can
+	// no longer matter: either its header was buffered already (and the
+	// mutation moved over by bufferHeaderLocked) or that block was
+	// orphaned without ever being observed, in which case it's beyond
+	// undoing regardless. Drop it so pendingMutations can't grow
+	// unbounded across an event whose header never arrives.
+	for hash, pending := range c.pendingMutations {
+		if pending.blockNum <= c.finalizedBlockNum {
+			delete(c.pendingMutations, hash)
+		}
+	}
+	return nil
+}
+
+// recordMutation appends m to the unfinalized block identified by
+// blockHash so it can be undone if that block is later orphaned by a
+// reorg. syncEventsLive (the contract logs subscription) and syncBlocksLive
+// (the new-heads subscription) run as independent goroutines with no
+// ordering guarantee between them, so the header for blockHash may not be
+// buffered yet when its event arrives; in that case m is held in
+// pendingMutations until bufferHeaderLocked moves it over. If blockNum is
+// already at or behind finalizedBlockNum, the block is already committed
+// (e.g. a block syncHistory processed beyond ConfirmationDepth) and m is
+// dropped: its effects are already final and can't be undone anyway.
+func (c *Client) recordMutation(blockNum uint64, blockHash common.Hash, m dbMutation) {
+	c.unfinalizedMu.Lock()
+	defer c.unfinalizedMu.Unlock()
+	for i := range c.unfinalized {
+		if c.unfinalized[i].header.Hash() == blockHash {
+			c.unfinalized[i].mutations = append(c.unfinalized[i].mutations, m)
+			return
+		}
+	}
+
+	if blockNum <= c.finalizedBlockNum {
+		return
+	}
+
+	if c.pendingMutations == nil {
+		c.pendingMutations = make(map[common.Hash]*pendingMutation)
+	}
+	pending, ok := c.pendingMutations[blockHash]
+	if !ok {
+		pending = &pendingMutation{blockNum: blockNum}
+		c.pendingMutations[blockHash] = pending
+	}
+	pending.mutations = append(pending.mutations, m)
+}
+
+// handleReorg is called when header's parent doesn't match the tip of the
+// buffered (unfinalized) chain: some of the buffered blocks were orphaned.
+// It walks back from header via HeaderByHash until it finds the common
+// ancestor with the buffered tail (or exhausts the buffer), undoes the db
+// mutations recorded for every orphaned block (most recent first), and
+// replays the events of the canonical blocks that replace them.
+func (c *Client) handleReorg(header *types.Header) error {
+	log.Warnf("chain reorg detected: new head %d (%s) does not extend the buffered tail",
+		header.Number.Uint64(), header.Hash().Hex())
+
+	c.unfinalizedMu.Lock()
+	defer c.unfinalizedMu.Unlock()
+
+	// walk back from header until its parent is either the tip of an
+	// unorphaned portion of the buffer (the common ancestor) or we run
+	// past the whole buffer. header itself is appended to unfinalized by
+	// the caller once this returns, so it's excluded from replacement.
+	var replacement []*types.Header
+	cursor := header
+	ancestorIdx := c.indexOfBufferedHashLocked(cursor.ParentHash)
+	for ancestorIdx < 0 && len(c.unfinalized) > 0 &&
+		cursor.Number.Uint64() > c.unfinalized[0].header.Number.Uint64() {
+		parent, err := c.client.HeaderByHash(context.Background(), cursor.ParentHash)
+		if err != nil {
+			return fmt.Errorf("error walking back reorged chain: %s", err)
+		}
+		cursor = parent
+		replacement = append(replacement, cursor)
+		ancestorIdx = c.indexOfBufferedHashLocked(cursor.ParentHash)
+	}
+
+	// undo the mutations of every orphaned block, most recent first
+	orphaned := c.unfinalized[ancestorIdx+1:]
+	for i := len(orphaned) - 1; i >= 0; i-- {
+		for j := len(orphaned[i].mutations) - 1; j >= 0; j-- {
+			if err := orphaned[i].mutations[j].undo(); err != nil {
+				return err
+			}
+		}
+	}
+	c.unfinalized = c.unfinalized[:ancestorIdx+1]
+
+	// replay the canonical blocks that replace them, oldest first. Like
+	// onNewHeader and seedUnfinalized, each replayed block must also
+	// freeze the processes whose ResPubStartBlock it reaches and record
+	// the matching undo, or a process frozen only during a reorg replay
+	// could never be unfrozen by a later reorg that orphans it.
+	for i := len(replacement) - 1; i >= 0; i-- {
+		h := replacement[i]
+		blockNum := h.Number.Uint64()
+
+		c.unfinalizedMu.Unlock()
+		err := c.db.FrozeProcessesByCurrentBlockNum(blockNum)
+		c.unfinalizedMu.Lock()
+		if err != nil {
+			return err
+		}
+
+		c.bufferHeaderLocked(h)
+
+		c.unfinalizedMu.Unlock()
+		c.recordMutation(blockNum, h.Hash(), dbMutation{undo: func() error {
+			return c.db.UnfreezeProcessesByBlockNum(blockNum)
+		}})
+		err = c.syncEventsHistory(h.Number, h.Number)
+		c.unfinalizedMu.Lock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedUnfinalized buffers, oldest first, every header from startBlock to
+// endBlock (inclusive) and replays its events, so that the still-unconfirmed
+// tail syncHistory saw on startup isn't silently skipped once syncBlocksLive
+// starts a brand new SubscribeNewHead subscription (which only ever
+// delivers headers from the point it subscribes onwards). Each header is
+// buffered before its events are replayed, the same order onNewHeader uses,
+// so mutations recorded against it are undoable like any other buffered
+// block.
+func (c *Client) seedUnfinalized(startBlock, endBlock uint64) error {
+	for n := startBlock; n <= endBlock; n++ {
+		blockNum := n // captured below; avoid sharing the loop variable
+		header, err := c.client.HeaderByNumber(context.Background(), big.NewInt(int64(blockNum)))
+		if err != nil {
+			return fmt.Errorf("error seeding unfinalized block %d: %s", blockNum, err)
+		}
+
+		if err := c.db.FrozeProcessesByCurrentBlockNum(blockNum); err != nil {
+			return err
+		}
+
+		c.unfinalizedMu.Lock()
+		c.bufferHeaderLocked(header)
+		c.unfinalizedMu.Unlock()
+
+		c.recordMutation(blockNum, header.Hash(), dbMutation{undo: func() error {
+			return c.db.UnfreezeProcessesByBlockNum(blockNum)
+		}})
+
+		if err := c.syncEventsHistory(big.NewInt(int64(blockNum)), big.NewInt(int64(blockNum))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexOfBufferedHashLocked returns the index in c.unfinalized of the
+// header with the given hash, or -1 if it isn't buffered. Callers must
+// hold c.unfinalizedMu.
+func (c *Client) indexOfBufferedHashLocked(hash common.Hash) int {
+	for i := range c.unfinalized {
+		if c.unfinalized[i].header.Hash() == hash {
+			return i
+		}
+	}
+	return -1
+}